@@ -0,0 +1,185 @@
+// Copyright (c) 2013, Peter H. Froehlich. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/phf/go-ratelimit/ratelimit/internal/clock"
+)
+
+// bucket implements a classic token-bucket rate limiter for a single
+// direction (read or write) of a RateLimitedConn, Listener or
+// MessageLimitedConn. Tokens accrue at rate per second (bytes, or
+// messages for MessageLimitedConn), capped at burst, and are spent before the
+// underlying IO happens so a single large Read or Write gets split
+// into several smaller syscalls instead of bursting straight past the
+// limit.
+type bucket struct {
+	mu       sync.Mutex
+	clk      clock.Clock
+	rate     int // tokens/sec, 0 means unlimited
+	burst    int
+	burstSet bool // true once SetBurst has been called explicitly
+	tokens   float64
+	last     time.Time
+}
+
+// newBucket returns a bucket rate-limited to rate bytes/sec (0 for
+// unlimited), with its burst defaulting to rate.
+func newBucket(rate int) *bucket {
+	return newBucketWithClock(rate, clock.Real)
+}
+
+// newBucketWithClock is like newBucket, but lets tests substitute a
+// clock.FakeClock for deterministic, instant rate-limiting.
+func newBucketWithClock(rate int, clk clock.Clock) *bucket {
+	return &bucket{rate: rate, burst: rate, clk: clk}
+}
+
+// refill tops up tokens based on time elapsed since the last refill,
+// capped at burst. The very first call primes the bucket so it starts
+// full, allowing an initial burst of up to burst bytes.
+func (b *bucket) refill() {
+	now := b.clk.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(b.burst)
+		b.last = now
+		return
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * float64(b.rate)
+		if b.tokens > float64(b.burst) {
+			b.tokens = float64(b.burst)
+		}
+		b.last = now
+	}
+}
+
+// takeCtx blocks, sleeping if necessary, until enough tokens are
+// available to satisfy either n or a full burst (whichever is
+// smaller), then returns how many of the n requested bytes may be
+// spent right now. This keeps a large Read or Write from degenerating
+// into a flood of one-byte syscalls once the initial burst is spent.
+// The wait can be cut short by ctx being cancelled or by deadline
+// passing (deadline is ignored if zero). On cancellation it returns
+// (0, ctx.Err()); on the deadline passing it returns (0,
+// os.ErrDeadlineExceeded); either way no tokens are spent.
+func (b *bucket) takeCtx(ctx context.Context, deadline time.Time, n int) (int, error) {
+	b.mu.Lock()
+
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return n, nil
+	}
+
+	need := n
+	if need > b.burst {
+		need = b.burst
+	}
+	if need < 1 {
+		need = 1
+	}
+
+	b.refill()
+	if b.tokens < float64(need) {
+		wait := time.Duration((float64(need) - b.tokens) / float64(b.rate) * float64(time.Second))
+		clk := b.clk
+		b.mu.Unlock()
+		if err := sleepCtx(ctx, deadline, wait, clk); err != nil {
+			return 0, err
+		}
+		b.mu.Lock()
+		b.refill()
+	}
+
+	allowed := int(b.tokens)
+	if allowed > n {
+		allowed = n
+	}
+	if allowed < 1 {
+		allowed = 1
+	}
+	b.tokens -= float64(allowed)
+	b.mu.Unlock()
+	return allowed, nil
+}
+
+// sleepCtx sleeps for d on clk, unless ctx is cancelled or deadline
+// passes first, in which case it returns ctx.Err() or
+// os.ErrDeadlineExceeded respectively. Deadlines are always measured
+// against the real wall clock, since net.Conn deadlines are.
+func sleepCtx(ctx context.Context, deadline time.Time, d time.Duration, clk clock.Clock) error {
+	if !deadline.IsZero() {
+		if left := time.Until(deadline); left <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		clk.Sleep(d)
+		close(done)
+	}()
+
+	var deadlineCh <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		deadlineCh = timer.C
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-deadlineCh:
+		return os.ErrDeadlineExceeded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// refund returns n previously taken tokens that ended up unused,
+// because the underlying IO transferred fewer bytes than it was
+// allowed to.
+func (b *bucket) refund(n int) {
+	if n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += float64(n)
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+}
+
+// setRate changes the bucket's rate. If no explicit burst has been
+// set, the burst keeps tracking the rate.
+func (b *bucket) setRate(rate int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+	if !b.burstSet {
+		b.burst = rate
+	}
+}
+
+// setBurst fixes the bucket's burst independently of its rate.
+func (b *bucket) setBurst(burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.burst = burst
+	b.burstSet = true
+}
+
+func (b *bucket) getRate() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
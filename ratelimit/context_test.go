@@ -0,0 +1,89 @@
+// Copyright (c) 2013, Peter H. Froehlich. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestContextCancel checks that a Read throttled by a slow rate limit
+// unblocks with ctx.Err() as soon as the context is cancelled, rather
+// than waiting out the full throttle delay.
+func TestContextCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rlc, err := NewWithContext(ctx, server, 1, 0) // 1 byte/sec: plenty slow
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		client.Write([]byte("hi"))
+	}()
+
+	// drain the burst byte so the second Read actually throttles
+	buf := make([]byte, 1)
+	if _, err := rlc.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err = rlc.Read(buf)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Read took %v, should have unblocked almost immediately on cancel", elapsed)
+	}
+}
+
+// TestDeadlineExceeded checks that a Read throttled by a slow rate
+// limit unblocks with os.ErrDeadlineExceeded once SetReadDeadline's
+// deadline passes.
+func TestDeadlineExceeded(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	rlc, err := New(server, 1, 0) // 1 byte/sec: plenty slow
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		client.Write([]byte("hi"))
+	}()
+
+	buf := make([]byte, 1)
+	if _, err := rlc.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rlc.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = rlc.Read(buf)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected os.ErrDeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Read took %v, should have unblocked almost immediately on deadline", elapsed)
+	}
+}
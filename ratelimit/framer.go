@@ -0,0 +1,75 @@
+// Copyright (c) 2013, Peter H. Froehlich. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Framer reports where one logical message ends within a buffer, so
+// NewMessage can count completed messages independently of raw byte
+// throughput. NextBoundary returns the offset of the first byte past
+// the end of the first complete message in b, or -1 if b does not
+// yet contain one.
+type Framer interface {
+	NextBoundary(b []byte) int
+}
+
+// LineFramer treats '\n' as the message delimiter, matching
+// line-oriented text protocols.
+type LineFramer struct{}
+
+// NextBoundary implements Framer.
+func (LineFramer) NextBoundary(b []byte) int {
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		return i + 1
+	}
+	return -1
+}
+
+// FixedSizeFramer treats every n bytes as one message.
+type FixedSizeFramer int
+
+// NextBoundary implements Framer.
+func (f FixedSizeFramer) NextBoundary(b []byte) int {
+	if len(b) < int(f) {
+		return -1
+	}
+	return int(f)
+}
+
+// LengthPrefixedFramer treats each message as a length prefix
+// followed by that many bytes of payload. If Varint is true the
+// prefix is a uvarint (as produced by encoding/binary.PutUvarint);
+// otherwise it's a big-endian uint32.
+type LengthPrefixedFramer struct {
+	Varint bool
+}
+
+// NextBoundary implements Framer.
+func (f LengthPrefixedFramer) NextBoundary(b []byte) int {
+	if f.Varint {
+		length, hdr := binary.Uvarint(b)
+		if hdr <= 0 {
+			return -1
+		}
+		total := hdr + int(length)
+		if len(b) < total {
+			return -1
+		}
+		return total
+	}
+
+	const hdr = 4
+	if len(b) < hdr {
+		return -1
+	}
+	total := hdr + int(binary.BigEndian.Uint32(b))
+	if len(b) < total {
+		return -1
+	}
+	return total
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2013, Peter H. Froehlich. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestLineFramer(t *testing.T) {
+	var f LineFramer
+	if got := f.NextBoundary([]byte("hello")); got != -1 {
+		t.Errorf("expected -1 for a line without a terminator, got %d", got)
+	}
+	if got := f.NextBoundary([]byte("hello\nworld")); got != 6 {
+		t.Errorf("expected boundary at 6, got %d", got)
+	}
+}
+
+func TestFixedSizeFramer(t *testing.T) {
+	f := FixedSizeFramer(4)
+	if got := f.NextBoundary([]byte("ab")); got != -1 {
+		t.Errorf("expected -1 for a short buffer, got %d", got)
+	}
+	if got := f.NextBoundary([]byte("abcdef")); got != 4 {
+		t.Errorf("expected boundary at 4, got %d", got)
+	}
+}
+
+func TestLengthPrefixedFramerUint32(t *testing.T) {
+	var f LengthPrefixedFramer
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, 3)
+	b = append(b, "abc"...)
+	if got := f.NextBoundary(b); got != 7 {
+		t.Errorf("expected boundary at 7, got %d", got)
+	}
+	if got := f.NextBoundary(b[:6]); got != -1 {
+		t.Errorf("expected -1 for a truncated message, got %d", got)
+	}
+}
+
+func TestLengthPrefixedFramerVarint(t *testing.T) {
+	f := LengthPrefixedFramer{Varint: true}
+	hdr := make([]byte, binary.MaxVarintLen64)
+	hdrLen := binary.PutUvarint(hdr, 3)
+	b := append(hdr[:hdrLen], "abc"...)
+	if got := f.NextBoundary(b); got != hdrLen+3 {
+		t.Errorf("expected boundary at %d, got %d", hdrLen+3, got)
+	}
+	if got := f.NextBoundary(b[:hdrLen+1]); got != -1 {
+		t.Errorf("expected -1 for a truncated message, got %d", got)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2013, Peter H. Froehlich. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file.
+
+// Package clock abstracts away the passage of time so rate-limiting
+// logic can be driven deterministically in tests instead of waiting
+// on the wall clock.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the seam between rate-limiting code and the passage of
+// time: Now reports the current time and Sleep blocks the calling
+// goroutine until d has passed.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// Real is the Clock backed by the actual wall clock and scheduler.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// FakeClock is a Clock whose time only moves when Advance is called.
+// Sleep blocks the calling goroutine until a later Advance moves the
+// clock's time past the requested duration, which lets tests assert
+// exact, instant behavior instead of tolerating wall-clock slop.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	wake time.Time
+	done chan struct{}
+}
+
+// NewFakeClock returns a FakeClock starting at start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the clock's current (fake) time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep blocks until the clock has been Advance-d to or past d from
+// now. A non-positive d returns immediately.
+func (c *FakeClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	done := make(chan struct{})
+	c.waiters = append(c.waiters, fakeWaiter{wake: c.now.Add(d), done: done})
+	c.mu.Unlock()
+
+	<-done
+}
+
+// Advance moves the clock forward by d, waking every pending Sleep
+// whose deadline has now passed.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	remaining := c.waiters[:0]
+	for _, w := range c.waiters {
+		if !w.wake.After(c.now) {
+			close(w.done)
+		} else {
+			remaining = append(remaining, w)
+		}
+	}
+	c.waiters = remaining
+}
+
+// BlockUntil blocks the calling goroutine until at least n other
+// goroutines are parked in Sleep on this clock. Tests use this to
+// make sure a sleeper has actually registered before calling Advance,
+// since Advance only wakes sleepers that are waiting at the time it
+// is called.
+func (c *FakeClock) BlockUntil(n int) {
+	for {
+		c.mu.Lock()
+		waiting := len(c.waiters)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
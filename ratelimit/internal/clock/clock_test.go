@@ -0,0 +1,66 @@
+// Copyright (c) 2013, Peter H. Froehlich. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file.
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockAdvanceWakesSleepers(t *testing.T) {
+	c := NewFakeClock(time.Unix(0, 0))
+
+	woke := make(chan time.Time, 1)
+	go func() {
+		c.Sleep(time.Second)
+		woke <- c.Now()
+	}()
+
+	select {
+	case <-woke:
+		t.Fatal("Sleep returned before Advance")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	c.Advance(500 * time.Millisecond)
+	select {
+	case <-woke:
+		t.Fatal("Sleep returned before its deadline")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	c.Advance(500 * time.Millisecond)
+	select {
+	case now := <-woke:
+		if want := time.Unix(1, 0); !now.Equal(want) {
+			t.Errorf("woke at %v, want %v", now, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Sleep did not return after Advance past its deadline")
+	}
+}
+
+func TestFakeClockBlockUntil(t *testing.T) {
+	c := NewFakeClock(time.Unix(0, 0))
+
+	go func() {
+		c.Sleep(time.Second)
+	}()
+
+	c.BlockUntil(1) // should return once the sleeper above registers
+	c.Advance(time.Second)
+}
+
+func TestFakeClockNow(t *testing.T) {
+	start := time.Unix(100, 0)
+	c := NewFakeClock(start)
+	if got := c.Now(); !got.Equal(start) {
+		t.Errorf("Now() = %v, want %v", got, start)
+	}
+	c.Advance(5 * time.Second)
+	if want := start.Add(5 * time.Second); !c.Now().Equal(want) {
+		t.Errorf("Now() = %v, want %v", c.Now(), want)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2013, Peter H. Froehlich. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener wraps a net.Listener so that every accepted connection
+// draws from a single shared read budget and a single shared write
+// budget, measured in bytes per second. Plain New only limits one
+// connection at a time, so accepting N connections from the same
+// Listener multiplies the effective throughput by N; Listener fixes
+// that by enforcing the aggregate with a shared token bucket.
+//
+// Optional per-connection caps (see SetConnLimits) can still be
+// layered on top of the shared budget.
+type Listener struct {
+	net.Listener
+	rbucket *bucket
+	wbucket *bucket
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu             sync.Mutex
+	connReadLimit  int
+	connWriteLimit int
+}
+
+// NewListener returns a Listener accepting connections from l whose
+// aggregate reads and writes are limited to readBitrate and
+// writeBitrate bytes per second. 0 means unlimited. Bursts default to
+// the configured bitrate; use SetBurst to change that.
+func NewListener(l net.Listener, readBitrate, writeBitrate int) (*Listener, error) {
+	if readBitrate < 0 || writeBitrate < 0 {
+		return nil, errors.New("read/write bitrates cannot be negative")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rll := &Listener{
+		Listener: l,
+		rbucket:  newBucket(readBitrate),
+		wbucket:  newBucket(writeBitrate),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	return rll, nil
+}
+
+// SetConnLimits establishes an additional per-connection cap (in bytes
+// per second, 0 for no cap) on top of the shared budget. It only
+// applies to connections accepted afterwards.
+func (rll *Listener) SetConnLimits(readLimit, writeLimit int) error {
+	if readLimit < 0 || writeLimit < 0 {
+		return errors.New("read/write limits cannot be negative")
+	}
+	rll.mu.Lock()
+	defer rll.mu.Unlock()
+	rll.connReadLimit = readLimit
+	rll.connWriteLimit = writeLimit
+	return nil
+}
+
+// SetReadBitrate changes the aggregate read budget shared by all
+// connections accepted from this Listener, including ones already
+// accepted.
+func (rll *Listener) SetReadBitrate(bps int) error {
+	if bps < 0 {
+		return errors.New("bitrate cannot be negative")
+	}
+	rll.rbucket.setRate(bps)
+	return nil
+}
+
+// SetWriteBitrate changes the aggregate write budget shared by all
+// connections accepted from this Listener, including ones already
+// accepted.
+func (rll *Listener) SetWriteBitrate(bps int) error {
+	if bps < 0 {
+		return errors.New("bitrate cannot be negative")
+	}
+	rll.wbucket.setRate(bps)
+	return nil
+}
+
+// ReadBitrate returns the current aggregate read budget in bytes per
+// second, 0 meaning unlimited.
+func (rll *Listener) ReadBitrate() int {
+	return rll.rbucket.getRate()
+}
+
+// WriteBitrate returns the current aggregate write budget in bytes
+// per second, 0 meaning unlimited.
+func (rll *Listener) WriteBitrate() int {
+	return rll.wbucket.getRate()
+}
+
+// SetBurst establishes the maximum number of bytes the aggregate
+// budget may let through in a single burst once it has had time to
+// refill, overriding the default of tracking the current bitrate. It
+// applies to both the shared read and write budgets.
+func (rll *Listener) SetBurst(n int) error {
+	if n < 0 {
+		return errors.New("burst cannot be negative")
+	}
+	rll.rbucket.setBurst(n)
+	rll.wbucket.setBurst(n)
+	return nil
+}
+
+// Accept waits for and returns the next connection, wrapped so its
+// reads and writes draw from the shared budget and any per-connection
+// caps configured via SetConnLimits.
+func (rll *Listener) Accept() (net.Conn, error) {
+	c, err := rll.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	rll.mu.Lock()
+	rlim, wlim := rll.connReadLimit, rll.connWriteLimit
+	rll.mu.Unlock()
+
+	var conn net.Conn = c
+	if rlim > 0 || wlim > 0 {
+		conn, err = New(c, rlim, wlim)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &sharedConn{Conn: conn, rbucket: rll.rbucket, wbucket: rll.wbucket, ctx: rll.ctx}, nil
+}
+
+// Close closes the underlying listener and cancels the shared
+// budgets' context, unblocking any connection currently waiting on
+// them.
+func (rll *Listener) Close() error {
+	rll.cancel()
+	return rll.Listener.Close()
+}
+
+// sharedConn draws its reads and writes from a pair of buckets shared
+// with every other connection accepted from the same Listener, the
+// same way RateLimitedConn draws from its own private pair, so it
+// honors the same deadline and cancellation contract.
+type sharedConn struct {
+	net.Conn
+	rbucket *bucket
+	wbucket *bucket
+	ctx     context.Context
+
+	mu        sync.Mutex
+	rDeadline time.Time
+	wDeadline time.Time
+}
+
+func (sc *sharedConn) Read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return sc.Conn.Read(b)
+	}
+	sc.mu.Lock()
+	deadline := sc.rDeadline
+	sc.mu.Unlock()
+	allowed, err := sc.rbucket.takeCtx(sc.ctx, deadline, len(b))
+	if err != nil {
+		return 0, err
+	}
+	n, err = sc.Conn.Read(b[:allowed])
+	if n < allowed {
+		sc.rbucket.refund(allowed - n)
+	}
+	return
+}
+
+func (sc *sharedConn) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		sc.mu.Lock()
+		deadline := sc.wDeadline
+		sc.mu.Unlock()
+		allowed, err := sc.wbucket.takeCtx(sc.ctx, deadline, len(b)-n)
+		if err != nil {
+			return n, err
+		}
+		m, werr := sc.Conn.Write(b[n : n+allowed])
+		if m < allowed {
+			sc.wbucket.refund(allowed - m)
+		}
+		n += m
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return n, nil
+}
+
+// SetDeadline sets the read and write deadlines on the underlying
+// connection, and on the throttle itself so a pending Read or Write
+// unblocks when it passes.
+func (sc *sharedConn) SetDeadline(t time.Time) error {
+	sc.mu.Lock()
+	sc.rDeadline = t
+	sc.wDeadline = t
+	sc.mu.Unlock()
+	return sc.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline on the underlying connection,
+// and on the throttle itself so a pending Read unblocks when it
+// passes.
+func (sc *sharedConn) SetReadDeadline(t time.Time) error {
+	sc.mu.Lock()
+	sc.rDeadline = t
+	sc.mu.Unlock()
+	return sc.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline on the underlying
+// connection, and on the throttle itself so a pending Write unblocks
+// when it passes.
+func (sc *sharedConn) SetWriteDeadline(t time.Time) error {
+	sc.mu.Lock()
+	sc.wDeadline = t
+	sc.mu.Unlock()
+	return sc.Conn.SetWriteDeadline(t)
+}
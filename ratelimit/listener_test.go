@@ -0,0 +1,203 @@
+// Copyright (c) 2013, Peter H. Froehlich. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestListenerBoundaries checks that NewListener rejects negative
+// bitrates, same as New does for per-connection limits.
+func TestListenerBoundaries(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err := NewListener(l, -1, 0); err == nil {
+		t.Errorf("expected NewListener to fail but it didn't")
+	}
+	if _, err := NewListener(l, 0, -1); err == nil {
+		t.Errorf("expected NewListener to fail but it didn't")
+	}
+}
+
+// TestListenerSharedBudget checks that two connections accepted from
+// the same Listener share a single read budget: reading npack*lpack
+// bytes from each of the two connections should take about as long as
+// reading all of it down a single 4096 bps connection would, not half
+// as long as it would if each connection got its own budget.
+func TestListenerSharedBudget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	const rlim = 4096
+	const npack, lpack = 8, 1024 // 8192 bytes per client
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rll, err := NewListener(raw, rlim, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rll.Close()
+
+	addr := raw.Addr().String()
+	for i := 0; i < 2; i++ {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			for j := 0; j < npack; j++ {
+				if _, err := c.Write(make([]byte, lpack)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	start := time.Now()
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		c, err := rll.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			buf := make([]byte, npack*lpack)
+			if _, err := io.ReadFull(c, buf); err != nil {
+				t.Error(err)
+			}
+			done <- struct{}{}
+		}(c)
+	}
+	<-done
+	<-done
+
+	// 2*npack*lpack = 16384 bytes shared at rlim=4096 bps, less the
+	// bucket's initial 4096-byte burst that goes through immediately,
+	// should take about 3 seconds; give it generous slack since this is
+	// a coarse wall-clock check against two real TCP connections.
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Errorf("finished in %v, too fast for a shared %d bps budget", elapsed, rlim)
+	}
+}
+
+// TestListenerDeadlineExceeded checks that a Read throttled by a slow
+// shared budget unblocks with os.ErrDeadlineExceeded once
+// SetReadDeadline's deadline passes, the same way TestDeadlineExceeded
+// checks it for RateLimitedConn.
+func TestListenerDeadlineExceeded(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	rll, err := NewListener(raw, 1, 0) // 1 byte/sec: plenty slow
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rll.Close()
+
+	client, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := rll.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil { // drains the initial burst byte
+		t.Fatal(err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = conn.Read(buf)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected os.ErrDeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Read took %v, should have unblocked almost immediately on deadline", elapsed)
+	}
+}
+
+// TestListenerCloseUnblocks checks that Close unblocks an
+// already-accepted connection parked on the shared budget, the same
+// way cancelling a RateLimitedConn's context unblocks it (see
+// TestContextCancel).
+func TestListenerCloseUnblocks(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	rll, err := NewListener(raw, 1, 0) // 1 byte/sec: plenty slow
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := rll.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil { // drains the initial burst byte
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		rll.Close()
+	}()
+
+	start := time.Now()
+	_, err = conn.Read(buf)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Read took %v, should have unblocked almost immediately on Close", elapsed)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2013, Peter H. Froehlich. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxMessageSize is the maximum number of bytes
+// MessageLimitedConn.Read will buffer while waiting for the Framer to
+// report a message boundary, unless overridden with
+// SetMaxMessageSize. Without a cap, a peer that never completes a
+// message (or a LengthPrefixedFramer frame declaring an outsized
+// length) could grow the internal buffer without bound.
+const DefaultMaxMessageSize = 1 << 20 // 1 MiB
+
+// ErrMessageTooLarge is returned by MessageLimitedConn.Read when a
+// message exceeds the configured maximum size (see
+// SetMaxMessageSize) before the Framer finds its boundary.
+var ErrMessageTooLarge = errors.New("ratelimit: message exceeds maximum size")
+
+// MessageLimitedConn wraps a net.Conn and shapes it to a maximum
+// number of messages per second, in each direction, on top of
+// whatever byte-rate limiting (if any) the wrapped conn already
+// applies. Messages are delimited by a Framer. Wrap a RateLimitedConn
+// (see New) in a MessageLimitedConn, or vice versa, to limit both
+// bytes/sec and msgs/sec at once.
+type MessageLimitedConn struct {
+	net.Conn
+	framer Framer
+	rmsg   *bucket // msgs/sec on Read
+	wmsg   *bucket // msgs/sec on Write
+	ctx    context.Context
+
+	mu      sync.Mutex
+	rbuf    []byte // bytes read from Conn but not yet handed to a caller
+	cleared int    // prefix of rbuf that has already been charged against rmsg
+	maxMsg  int    // cap on len(rbuf) while searching for a boundary, 0 means unlimited
+
+	dmu       sync.Mutex
+	rDeadline time.Time
+	wDeadline time.Time
+}
+
+// NewMessage returns a connection whose reads and writes are shaped
+// to readMsgLim and writeMsgLim messages per second (0 means no
+// limit), with message boundaries determined by framer.
+//
+// It is equivalent to NewMessageWithContext(context.Background(),
+// conn, readMsgLim, writeMsgLim, framer).
+func NewMessage(conn net.Conn, readMsgLim, writeMsgLim int, framer Framer) (net.Conn, error) {
+	return NewMessageWithContext(context.Background(), conn, readMsgLim, writeMsgLim, framer)
+}
+
+// NewMessageWithContext is like NewMessage, except throttled reads and
+// writes also unblock when ctx is done, returning ctx.Err(), and when
+// the connection's read or write deadline (SetDeadline,
+// SetReadDeadline, SetWriteDeadline) passes, returning
+// os.ErrDeadlineExceeded. In either case the pending message is not
+// read or written.
+func NewMessageWithContext(ctx context.Context, conn net.Conn, readMsgLim, writeMsgLim int, framer Framer) (net.Conn, error) {
+	if readMsgLim < 0 || writeMsgLim < 0 {
+		return nil, errors.New("read/write message limits cannot be negative")
+	}
+	if framer == nil {
+		return nil, errors.New("framer cannot be nil")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &MessageLimitedConn{
+		Conn:   conn,
+		framer: framer,
+		rmsg:   newBucket(readMsgLim),
+		wmsg:   newBucket(writeMsgLim),
+		ctx:    ctx,
+		maxMsg: DefaultMaxMessageSize,
+	}, nil
+}
+
+// SetMaxMessageSize changes the maximum number of bytes Read will
+// buffer while waiting for the Framer to report a message boundary
+// (0 means unlimited). Read returns ErrMessageTooLarge once a message
+// exceeds this size without completing.
+func (mlc *MessageLimitedConn) SetMaxMessageSize(n int) error {
+	if n < 0 {
+		return errors.New("max message size cannot be negative")
+	}
+	mlc.mu.Lock()
+	mlc.maxMsg = n
+	mlc.mu.Unlock()
+	return nil
+}
+
+// Read reads data from the connection, blocking as needed so that no
+// more than the configured number of messages per second are
+// delivered. A message's bytes are only released to the caller once
+// the full message has been read from the underlying connection,
+// except that when the underlying Read fails, any buffered bytes of an
+// incomplete message are handed back unpaced. If no boundary is found
+// before the buffered message grows past SetMaxMessageSize, Read
+// returns ErrMessageTooLarge instead of continuing to buffer.
+func (mlc *MessageLimitedConn) Read(b []byte) (n int, err error) {
+	mlc.mu.Lock()
+	defer mlc.mu.Unlock()
+
+	for mlc.cleared == 0 {
+		if end := mlc.framer.NextBoundary(mlc.rbuf); end > 0 {
+			mlc.dmu.Lock()
+			deadline := mlc.rDeadline
+			mlc.dmu.Unlock()
+			if _, err := mlc.rmsg.takeCtx(mlc.ctx, deadline, 1); err != nil {
+				return 0, err
+			}
+			mlc.cleared = end
+			break
+		}
+
+		if mlc.maxMsg > 0 && len(mlc.rbuf) > mlc.maxMsg {
+			mlc.rbuf = nil
+			return 0, ErrMessageTooLarge
+		}
+
+		chunk := make([]byte, 4096)
+		m, rerr := mlc.Conn.Read(chunk)
+		if m > 0 {
+			mlc.rbuf = append(mlc.rbuf, chunk[:m]...)
+		}
+		if rerr != nil {
+			if len(mlc.rbuf) == 0 {
+				return 0, rerr
+			}
+			// hand back whatever we have; the caller will see the
+			// error on the next Read once rbuf is drained
+			n = copy(b, mlc.rbuf)
+			mlc.rbuf = mlc.rbuf[n:]
+			return n, nil
+		}
+	}
+
+	n = copy(b, mlc.rbuf[:mlc.cleared])
+	mlc.rbuf = mlc.rbuf[n:]
+	mlc.cleared -= n
+	return n, nil
+}
+
+// Write writes data to the connection, blocking as needed so that no
+// more than the configured number of messages per second are sent.
+// Each complete message found in b (via framer) is paced separately;
+// trailing bytes that don't complete a message are written through
+// unpaced, since there's nothing left to count yet.
+func (mlc *MessageLimitedConn) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		end := mlc.framer.NextBoundary(b[n:])
+		if end < 0 {
+			m, werr := mlc.Conn.Write(b[n:])
+			n += m
+			return n, werr
+		}
+
+		mlc.dmu.Lock()
+		deadline := mlc.wDeadline
+		mlc.dmu.Unlock()
+		if _, err := mlc.wmsg.takeCtx(mlc.ctx, deadline, 1); err != nil {
+			return n, err
+		}
+
+		m, werr := mlc.Conn.Write(b[n : n+end])
+		n += m
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return n, nil
+}
+
+// SetDeadline sets the read and write deadlines on the underlying
+// connection, and on the throttle itself so a pending Read or Write
+// unblocks when it passes.
+func (mlc *MessageLimitedConn) SetDeadline(t time.Time) error {
+	mlc.dmu.Lock()
+	mlc.rDeadline = t
+	mlc.wDeadline = t
+	mlc.dmu.Unlock()
+	return mlc.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline on the underlying connection,
+// and on the throttle itself so a pending Read unblocks when it
+// passes.
+func (mlc *MessageLimitedConn) SetReadDeadline(t time.Time) error {
+	mlc.dmu.Lock()
+	mlc.rDeadline = t
+	mlc.dmu.Unlock()
+	return mlc.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline on the underlying
+// connection, and on the throttle itself so a pending Write unblocks
+// when it passes.
+func (mlc *MessageLimitedConn) SetWriteDeadline(t time.Time) error {
+	mlc.dmu.Lock()
+	mlc.wDeadline = t
+	mlc.dmu.Unlock()
+	return mlc.Conn.SetWriteDeadline(t)
+}
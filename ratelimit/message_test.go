@@ -0,0 +1,197 @@
+// Copyright (c) 2013, Peter H. Froehlich. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// accuracy is the wall-clock slop this package's real-network tests
+// tolerate, since real TCP connections always jitter a bit.
+const accuracy = 0.2
+
+func TestMessageBoundaries(t *testing.T) {
+	if _, err := NewMessage(nil, -1, 10, LineFramer{}); err == nil {
+		t.Errorf("expected NewMessage to fail but it didn't")
+	}
+	if _, err := NewMessage(nil, 10, -1, LineFramer{}); err == nil {
+		t.Errorf("expected NewMessage to fail but it didn't")
+	}
+	if _, err := NewMessage(nil, 10, 10, nil); err == nil {
+		t.Errorf("expected NewMessage to fail without a framer but it didn't")
+	}
+}
+
+// TestMessageRate checks that a writer limited to msgsPerSec
+// messages/sec, sending nmsg single-line messages, takes about as
+// long as the message budget (not the byte budget, which is left
+// unlimited) dictates.
+func TestMessageRate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	const msgsPerSec = 4
+	const nmsg = 8 // burst defaults to msgsPerSec, so nmsg-msgsPerSec are paced
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", raw.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		wlc, err := NewMessage(c, 0, msgsPerSec, LineFramer{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for i := 0; i < nmsg; i++ {
+			if _, err := wlc.Write([]byte("hello\n")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	c, err := raw.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	r := bufio.NewReader(c)
+	for i := 0; i < nmsg; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+
+	expected := time.Duration(nmsg-msgsPerSec) * time.Second / msgsPerSec
+	lower := time.Duration(float64(expected) * (1 - accuracy))
+	if elapsed < lower {
+		t.Errorf("received %d messages in %v, expected at least %v", nmsg, elapsed, lower)
+	}
+}
+
+// TestMessageContextCancel checks that a Read throttled by a slow
+// message rate unblocks with ctx.Err() as soon as the context is
+// cancelled, the same way TestContextCancel checks it for
+// RateLimitedConn.
+func TestMessageContextCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mlc, err := NewMessageWithContext(ctx, server, 1, 0, LineFramer{}) // 1 msg/sec: plenty slow
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		client.Write([]byte("one\ntwo\n"))
+	}()
+
+	buf := make([]byte, 64)
+	if _, err := mlc.Read(buf); err != nil { // drains the initial burst message
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err = mlc.Read(buf)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Read took %v, should have unblocked almost immediately on cancel", elapsed)
+	}
+}
+
+// TestMessageDeadlineExceeded checks that a Read throttled by a slow
+// message rate unblocks with os.ErrDeadlineExceeded once
+// SetReadDeadline's deadline passes, the same way TestDeadlineExceeded
+// checks it for RateLimitedConn.
+func TestMessageDeadlineExceeded(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	mlc, err := NewMessage(server, 1, 0, LineFramer{}) // 1 msg/sec: plenty slow
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		client.Write([]byte("one\ntwo\n"))
+	}()
+
+	buf := make([]byte, 64)
+	if _, err := mlc.Read(buf); err != nil { // drains the initial burst message
+		t.Fatal(err)
+	}
+
+	if err := mlc.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = mlc.Read(buf)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected os.ErrDeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Read took %v, should have unblocked almost immediately on deadline", elapsed)
+	}
+}
+
+// TestMessageTooLarge checks that Read gives up with
+// ErrMessageTooLarge instead of buffering without bound when a peer
+// never completes a message within the configured cap.
+func TestMessageTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	mlc, err := NewMessage(server, 0, 0, LineFramer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := mlc.(*MessageLimitedConn)
+	if err := mc.SetMaxMessageSize(-1); err == nil {
+		t.Errorf("expected SetMaxMessageSize to fail but it didn't")
+	}
+	if err := mc.SetMaxMessageSize(4); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		client.Write([]byte("too long, no newline"))
+	}()
+
+	buf := make([]byte, 64)
+	if _, err := mlc.Read(buf); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+}
@@ -5,131 +5,201 @@
 // Package ratelimit provides a rate-limiting wrapper for net.Conn
 // network connections.
 //
-// Our approach to rate-limiting is somewhat crude: We simply sleep
-// for an appropriate amount of time after each Read or Write. This
-// assumes (for Read limiting anyway) that TCP's congestion control
-// mechanisms eventually "catch on" and reduce the amount of traffic
-// they send our way.
+// Reads and writes are shaped with a token-bucket algorithm: tokens
+// accrue at the configured rate (bytes/sec) up to a burst, and are
+// spent before the underlying IO happens. This splits a large Read or
+// Write into several smaller syscalls instead of letting it burst
+// straight past the limit, and stays accurate even for many small
+// IOs in a row.
 package ratelimit
 
 import (
+	"context"
 	"errors"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/phf/go-ratelimit/ratelimit/internal/clock"
 )
 
+// RateLimitedConn wraps a net.Conn and shapes its reads and writes to
+// independently configurable byte rates.
 type RateLimitedConn struct {
-	net.Conn               // underlying network connection
-	rlim, wlim   int       // in bytes/second, 0 means no limit
-	rtime, wtime time.Time // time of last actual read/write
+	net.Conn         // underlying network connection
+	rbucket  *bucket // governs Read
+	wbucket  *bucket // governs Write
+	ctx      context.Context
+
+	mu        sync.Mutex
+	rDeadline time.Time
+	wDeadline time.Time
 }
 
 // New returns a rate-limited connection based on the given connection.
 // The limits are specified in bytes per second (bps) and 0 means no
-// limit.
+// limit. Bursts default to the configured limit; use SetBurst to
+// change that.
 //
-// Note that rate-limiting doesn't take connection deadlines into account
-// (see SetDeadline, SetReadDeadline, and SetWriteDeadline) so be careful
-// when using both.
+// It is equivalent to NewWithContext(context.Background(), conn,
+// readLimit, writeLimit).
 func New(conn net.Conn, readLimit, writeLimit int) (rlc net.Conn, err error) {
+	return NewWithContext(context.Background(), conn, readLimit, writeLimit)
+}
+
+// NewWithContext is like New, except throttled reads and writes also
+// unblock when ctx is done, returning ctx.Err(), and when the
+// connection's read or write deadline (SetDeadline, SetReadDeadline,
+// SetWriteDeadline) passes, returning os.ErrDeadlineExceeded. In
+// either case no IO is performed.
+func NewWithContext(ctx context.Context, conn net.Conn, readLimit, writeLimit int) (net.Conn, error) {
+	return newWithClock(ctx, conn, readLimit, writeLimit, clock.Real)
+}
+
+// newWithClock is the shared implementation behind New and
+// NewWithContext; tests substitute a clock.FakeClock so rate-limiting
+// can be exercised without waiting on the wall clock.
+func newWithClock(ctx context.Context, conn net.Conn, readLimit, writeLimit int, clk clock.Clock) (*RateLimitedConn, error) {
 	if readLimit < 0 || writeLimit < 0 {
-		err = errors.New("read/write limits cannot be negative")
-		return
+		return nil, errors.New("read/write limits cannot be negative")
 	}
-	rlc = RateLimitedConn{Conn: conn, rlim: readLimit, wlim: writeLimit}
-	return
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &RateLimitedConn{
+		Conn:    conn,
+		rbucket: newBucketWithClock(readLimit, clk),
+		wbucket: newBucketWithClock(writeLimit, clk),
+		ctx:     ctx,
+	}, nil
 }
 
 // Read reads data from the connection.
-// If necessary this function will sleep for an appropriate amount
-// of time to achieve the requested rate-limit.
-func (rlc RateLimitedConn) Read(b []byte) (n int, err error) {
-	// fast path if there is no limit
-	if rlc.rlim <= 0 {
-		n, err = rlc.Conn.Read(b)
-		return
+// If necessary this function will block for an appropriate amount
+// of time, and read less than len(b) bytes, to achieve the requested
+// rate-limit. The block ends early, without performing the read, if
+// the connection's read deadline passes or the context passed to
+// NewWithContext is done.
+func (rlc *RateLimitedConn) Read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return rlc.Conn.Read(b)
 	}
-
-	// lazy initialization
-	if rlc.rtime.IsZero() {
-		rlc.rtime = time.Now()
+	rlc.mu.Lock()
+	deadline := rlc.rDeadline
+	rlc.mu.Unlock()
+	allowed, err := rlc.rbucket.takeCtx(rlc.ctx, deadline, len(b))
+	if err != nil {
+		return 0, err
 	}
-
-	// perform the read operation
-	n, err = rlc.Conn.Read(b)
-
-	// how long since the last read?
-	t := time.Now()
-	d := t.Sub(rlc.rtime).Nanoseconds()
-
-	// allowed time
-	timePerByte := time.Second.Nanoseconds() / int64(rlc.rlim)
-	timeForNBytes := timePerByte * int64(n)
-
-	// sleep if we have to
-	if n > 0 && d < timeForNBytes {
-		time.Sleep(time.Duration(timeForNBytes - d))
+	n, err = rlc.Conn.Read(b[:allowed])
+	if n < allowed {
+		rlc.rbucket.refund(allowed - n)
 	}
-
-	// remember when last read finished
-	rlc.rtime = t
 	return
 }
 
 // Write writes data to the connection.
-// If necessary this function will sleep for an appropriate amount
-// of time to achieve the requested rate-limit.
-func (rlc RateLimitedConn) Write(b []byte) (n int, err error) {
-	// fast path if there is no limit
-	if rlc.wlim <= 0 {
-		n, err = rlc.Conn.Write(b)
-		return
-	}
-
-	// lazy initialization
-	if rlc.wtime.IsZero() {
-		rlc.wtime = time.Now()
-	}
-
-	// perform the write operation
-	n, err = rlc.Conn.Write(b)
-
-	// how long since the last write?
-	t := time.Now()
-	d := t.Sub(rlc.wtime).Nanoseconds()
-
-	// allowed time
-	timePerByte := time.Second.Nanoseconds() / int64(rlc.wlim)
-	timeForNBytes := timePerByte * int64(n)
-
-	// sleep if we have to
-	if n > 0 && d < timeForNBytes {
-		time.Sleep(time.Duration(timeForNBytes - d))
+// If necessary this function will block for an appropriate amount
+// of time, splitting b across several underlying writes, to achieve
+// the requested rate-limit. The block ends early, without performing
+// that write, if the connection's write deadline passes or the
+// context passed to NewWithContext is done.
+func (rlc *RateLimitedConn) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		rlc.mu.Lock()
+		deadline := rlc.wDeadline
+		rlc.mu.Unlock()
+		allowed, err := rlc.wbucket.takeCtx(rlc.ctx, deadline, len(b)-n)
+		if err != nil {
+			return n, err
+		}
+		m, werr := rlc.Conn.Write(b[n : n+allowed])
+		if m < allowed {
+			rlc.wbucket.refund(allowed - m)
+		}
+		n += m
+		if werr != nil {
+			return n, werr
+		}
 	}
-
-	// remember when last write finished
-	rlc.wtime = t
-	return
+	return n, nil
 }
 
 // SetReadLimit establishes a new limit (in bytes per second, 0 for
 // no limit) for reading from this connection.
-func (rlc RateLimitedConn) SetReadLimit(lim int) (err error) {
+func (rlc *RateLimitedConn) SetReadLimit(lim int) (err error) {
 	if lim < 0 {
 		err = errors.New("read limit cannot be negative")
 		return
 	}
-	rlc.rlim = lim
+	rlc.rbucket.setRate(lim)
 	return
 }
 
 // SetWriteLimit establishes a new limit (in bytes per second, 0 for
 // no limit) for writing to this connection.
-func (rlc RateLimitedConn) SetWriteLimit(lim int) (err error) {
+func (rlc *RateLimitedConn) SetWriteLimit(lim int) (err error) {
 	if lim < 0 {
 		err = errors.New("write limit cannot be negative")
 		return
 	}
-	rlc.wlim = lim
+	rlc.wbucket.setRate(lim)
+	return
+}
+
+// ReadLimit returns the current read limit in bytes per second, 0
+// meaning unlimited.
+func (rlc *RateLimitedConn) ReadLimit() int {
+	return rlc.rbucket.getRate()
+}
+
+// WriteLimit returns the current write limit in bytes per second, 0
+// meaning unlimited.
+func (rlc *RateLimitedConn) WriteLimit() int {
+	return rlc.wbucket.getRate()
+}
+
+// SetBurst establishes the maximum number of bytes that Read or Write
+// may let through in a single burst once the token bucket has had
+// time to refill, overriding the default of tracking the current
+// limit. It applies to both directions.
+func (rlc *RateLimitedConn) SetBurst(n int) (err error) {
+	if n < 0 {
+		err = errors.New("burst cannot be negative")
+		return
+	}
+	rlc.rbucket.setBurst(n)
+	rlc.wbucket.setBurst(n)
 	return
 }
+
+// SetDeadline sets the read and write deadlines on the underlying
+// connection, and on the throttle itself so a pending Read or Write
+// unblocks when it passes.
+func (rlc *RateLimitedConn) SetDeadline(t time.Time) error {
+	rlc.mu.Lock()
+	rlc.rDeadline = t
+	rlc.wDeadline = t
+	rlc.mu.Unlock()
+	return rlc.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline on the underlying connection,
+// and on the throttle itself so a pending Read unblocks when it
+// passes.
+func (rlc *RateLimitedConn) SetReadDeadline(t time.Time) error {
+	rlc.mu.Lock()
+	rlc.rDeadline = t
+	rlc.mu.Unlock()
+	return rlc.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline on the underlying
+// connection, and on the throttle itself so a pending Write unblocks
+// when it passes.
+func (rlc *RateLimitedConn) SetWriteDeadline(t time.Time) error {
+	rlc.mu.Lock()
+	rlc.wDeadline = t
+	rlc.mu.Unlock()
+	return rlc.Conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2013, Peter H. Froehlich. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/phf/go-ratelimit/ratelimit/internal/clock"
+)
+
+// TestWriteRateExact drives a RateLimitedConn's Write with a
+// clock.FakeClock instead of the wall clock, so it can assert the
+// exact number of bytes delivered at each virtual second instead of
+// tolerating real-network jitter. A rate of 100 bytes/sec with the default burst (100) lets
+// 100 bytes through immediately, then exactly 100 more per advanced
+// second.
+func TestWriteRateExact(t *testing.T) {
+	const rate = 100
+	const total = 250
+
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+	defer serverRaw.Close()
+
+	clk := clock.NewFakeClock(time.Unix(0, 0))
+	wlc, err := newWithClock(context.Background(), clientRaw, 0, rate, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := wlc.Write(make([]byte, total))
+		writeErr <- err
+	}()
+
+	buf := make([]byte, total)
+	received := 0
+
+	read := func() int {
+		n, err := serverRaw.Read(buf[received:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		received += n
+		return n
+	}
+
+	if n := read(); n != rate {
+		t.Errorf("burst: got %d bytes, want %d", n, rate)
+	}
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	if n := read(); n != rate {
+		t.Errorf("after 1s: got %d bytes, want %d", n, rate)
+	}
+
+	clk.BlockUntil(1)
+	clk.Advance(500 * time.Millisecond)
+	if n := read(); n != total-2*rate {
+		t.Errorf("after 1.5s: got %d bytes, want %d", n, total-2*rate)
+	}
+
+	if err := <-writeErr; err != nil {
+		t.Fatal(err)
+	}
+	if received != total {
+		t.Errorf("received %d bytes total, want %d", received, total)
+	}
+}
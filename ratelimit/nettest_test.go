@@ -0,0 +1,42 @@
+// Copyright (c) 2013, Peter H. Froehlich. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/nettest"
+)
+
+// TestConn runs the standard nettest.TestConn conformance suite
+// (deadline semantics, concurrent Read/Write, Close unblocking
+// pending calls, and so on) against a net.Pipe() wrapped in New, to
+// make sure RateLimitedConn is still a well-behaved net.Conn and not
+// just fast enough.
+func TestConn(t *testing.T) {
+	nettest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+		p1, p2 := net.Pipe()
+
+		rlc1, err := New(p1, 0, 0)
+		if err != nil {
+			p1.Close()
+			p2.Close()
+			return nil, nil, nil, err
+		}
+		rlc2, err := New(p2, 0, 0)
+		if err != nil {
+			rlc1.Close()
+			p2.Close()
+			return nil, nil, nil, err
+		}
+
+		stop = func() {
+			rlc1.Close()
+			rlc2.Close()
+		}
+		return rlc1, rlc2, stop, nil
+	})
+}